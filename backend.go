@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"os"
+)
+
+// BackendError is returned by a Backend's Sync. Some backends treat
+// certain failures as a no-op rather than a real error (e.g. git's
+// "nothing to commit" exit status); IsNoop lets callers tell the two
+// apart without knowing which concrete backend produced the error.
+type BackendError interface {
+	error
+	IsNoop() bool
+}
+
+// Backend is implemented by anything loftus can use to mirror rootDir
+// to a remote: watch for local changes, push them out, and notify the
+// client when a remote push has landed. ctx is the kill context:
+// cancelling it force-kills whatever external command the backend has
+// in flight (see GitBackend.git's use of exec.CommandContext).
+type Backend interface {
+	Sync(ctx context.Context) BackendError
+	Changed(ctx context.Context, filename string)
+	ShouldWatch(filename string) bool
+	RegisterPushHook(func())
+
+	// Invoke runs a Sync triggered from outside the watch loop (e.g.
+	// the HTTP /sync endpoint), tracked by the same WaitGroup as
+	// Changed's debounced syncs, so Wait() still blocks on it.
+	Invoke(ctx context.Context) BackendError
+
+	// Wait blocks until any sync scheduled by Changed or Invoke has
+	// finished or been killed. startClient calls this after the watch
+	// loop has stopped, so main doesn't exit while a sync is still
+	// draining.
+	Wait()
+}
+
+// NewBackend builds the Backend selected by config.backend ("git",
+// "hg" or "rsync"). done is closed on shutdown, before ctx's grace
+// period expires, so a pending debounce sleep can abort immediately
+// instead of waiting out the clock. "hg" is accepted on the command
+// line but has no backend of its own: it logs a warning and then syncs
+// with the git backend.
+func NewBackend(config *Config, done <-chan struct{}) Backend {
+	switch config.backend {
+	case "rsync":
+		return NewRsyncBackend(config, done)
+	case "hg":
+		l.Warn("sync", "-backend=hg is not implemented yet, falling back to git")
+		return NewGitBackend(config, done)
+	case "git", "":
+		return NewGitBackend(config, done)
+	default:
+		l.Error("sync", "Unknown -backend: ", config.backend)
+		os.Exit(1)
+		return nil
+	}
+}
@@ -1,50 +1,83 @@
 package main
 
 import (
-	"exp/inotify"
+	"context"
 	"flag"
-	"log"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"laudarch/loftus/internal/logger"
 )
 
+// l is the single package-level logger used throughout the client,
+// backends and comms. Its output starts on stderr and is pointed at
+// the configured log file once flags are parsed; LOFTUS_TRACE picks
+// which facilities ("sync", "watch", "net", "git") get Debug/Info
+// chatter, Warn/Error always get through.
+var l = logger.New(os.Stderr)
+
 const (
-	INTERESTING = inotify.IN_MODIFY | inotify.IN_CREATE | inotify.IN_DELETE | inotify.IN_MOVE
+	// How long in-flight git commands get to finish on their own after
+	// a SIGINT/SIGTERM before loftus force-kills them (the "HammerTime"
+	// grace period).
+	ShutdownGrace = 10 * time.Second
+
+	// Poll interval used when fsnotify can't watch rootDir at all (e.g.
+	// NFS/SMB/overlayfs) and -poll wasn't given explicitly.
+	PollFallbackInterval = 30 * time.Second
 )
 
-type Backend interface {
-	Sync() error
-	Changed(filename string)
-	ShouldWatch(filename string) bool
-	RegisterPushHook(func())
-}
-
 type Config struct {
-	isServer   bool
-	isCheck    bool
-	serverAddr string
-	syncDir    string
-	logDir     string
-	stdout     bool
+	isServer     bool
+	isCheck      bool
+	serverAddr   string
+	syncDir      string
+	logDir       string
+	stdout       bool
+	backend      string
+	remoteSpec   string
+	httpAddr     string
+	pollInterval time.Duration
 }
 
 type Client struct {
 	backend  Backend
 	rootDir  string
-	watcher  *inotify.Watcher
-	logger   *log.Logger
+	watcher  *fsnotify.Watcher
 	incoming chan string
+	done     <-chan struct{}
 }
 
 func main() {
 
 	config := confFromFlags()
-	log.Println("Logging to ", config.logDir)
+	l.Info("watch", "Logging to ", config.logDir)
 
 	os.Mkdir(config.logDir, 0750)
 
+	// ctx is canceled by hammerTime once the shutdown grace period
+	// expires; it is the context in-flight git commands run under, so
+	// cancellation is what actually force-kills them. done is closed
+	// immediately on the first signal, so loops can stop promptly
+	// without waiting for the grace period.
+	ctx, hammerTime := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		l.Warn("watch", "Shutting down, waiting up to", ShutdownGrace, "for in-flight sync to finish")
+		close(done)
+		time.AfterFunc(ShutdownGrace, hammerTime)
+	}()
+
 	if config.isCheck {
 		runCheck(config)
 
@@ -54,8 +87,10 @@ func main() {
 	} else {
         // No point making the sync dir, it needs to be a repo
 	    //os.Mkdir(config.syncDir, 0750)
-		startClient(config)
+		startClient(config, ctx, done)
 	}
+
+	l.Info("watch", "loftus finished")
 }
 
 // Parse commands line flags in to a configuration object
@@ -80,30 +115,58 @@ func confFromFlags() *Config {
 
 	var stdout = flag.Bool("stdout", false, "Log to stdout")
 
+	var backend = flag.String(
+		"backend",
+		"git",
+		"VCS/sync backend to use: git, hg or rsync")
+
+	var remoteSpec = flag.String(
+		"remote",
+		"",
+		"Remote spec for the rsync backend, e.g. user@host:/path")
+
+	var httpAddr = flag.String(
+		"http",
+		"",
+		"If set, serve /status, /sync and /archive on this address, e.g. 127.0.0.1:8008")
+
+	var pollInterval = flag.Duration(
+		"poll",
+		0,
+		"Also poll for changes this often, alongside filesystem events; if unset, polling every 30s is used only when the filesystem watch on -dir can't be set up")
+
 	flag.Parse()
 
 	return &Config{
-		isServer:   *isServer,
-		isCheck:    *isCheck,
-		serverAddr: *serverAddr,
-		syncDir:    *syncDir,
-		logDir:     *logDir,
-		stdout:     *stdout}
+		isServer:     *isServer,
+		isCheck:      *isCheck,
+		serverAddr:   *serverAddr,
+		syncDir:      *syncDir,
+		logDir:       *logDir,
+		stdout:       *stdout,
+		backend:      *backend,
+		remoteSpec:   *remoteSpec,
+		httpAddr:     *httpAddr,
+		pollInterval: *pollInterval}
 }
 
 // Watch directories, called sync methods on backend, etc
-func startClient(config *Config) {
+func startClient(config *Config, ctx context.Context, done <-chan struct{}) {
 
 	syncDir := config.syncDir
 
-	logger := openLog(config, "client.log")
+	configureLogOutput(config, "client.log")
 
-	logger.Println("Synchronising: ", syncDir)
+	l.Info("watch", "Synchronising: ", syncDir)
 
 	syncDir = strings.TrimRight(syncDir, "/")
-	backend := NewGitBackend(config)
+	backend := NewBackend(config, done)
 
-	watcher, _ := inotify.NewWatcher()
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		l.Error("watch", "Error creating watcher", err)
+		os.Exit(1)
+	}
 
 	incomingChannel := make(chan string)
 
@@ -111,40 +174,62 @@ func startClient(config *Config) {
 		rootDir:  syncDir,
 		backend:  backend,
 		watcher:  watcher,
-		logger:   logger,
 		incoming: incomingChannel,
+		done:     done,
+	}
+	rootWatched := client.addWatches()
+
+	pollInterval := config.pollInterval
+	if pollInterval == 0 && !rootWatched {
+		l.Warn("watch", "filesystem watch unavailable, falling back to polling every", PollFallbackInterval)
+		pollInterval = PollFallbackInterval
+	}
+	if pollInterval > 0 {
+		go client.poll(ctx, pollInterval)
+	}
+
+	if config.httpAddr != "" {
+		go startHTTPServer(config, backend, ctx)
 	}
-	client.addWatches()
 
 	// Always start with a sync to bring us up to date
-	err := backend.Sync()
-	if err != nil && err.(*GitError).status != 1 {
-		Warn(err.Error())
+	syncErr := backend.Sync(ctx)
+	if syncErr != nil && !syncErr.IsNoop() {
+		l.Warn("sync", syncErr.Error())
 	}
 
-	go udpListen(logger, incomingChannel)
-	go tcpListen(logger, config.serverAddr, incomingChannel)
-	client.run()
+	go udpListen(incomingChannel)
+	go tcpListen(config.serverAddr, incomingChannel)
+	client.run(ctx)
+
+	// The watcher is closed and the loop above has returned; wait for
+	// any sync still in flight to finish (or be force-killed once
+	// hammerTime fires) before we return and let main exit.
+	backend.Wait()
 }
 
-func openLog(config *Config, name string) *log.Logger {
+// configureLogOutput points the package-level logger l at the
+// configured log file (or stdout, with -stdout).
+func configureLogOutput(config *Config, name string) {
 
 	if config.stdout {
-		return log.New(os.Stdout, "", log.LstdFlags)
+		l.SetOutput(os.Stdout)
+		return
 	}
 
 	writer, err := os.OpenFile(
 		config.logDir+name, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0650)
 
 	if err != nil {
-		log.Fatal("Error opening log file", name, " in ", config.logDir, err)
+		l.Error("watch", "Error opening log file", name, "in", config.logDir, err)
+		os.Exit(1)
 	}
 
-	return log.New(writer, "", log.LstdFlags)
+	l.SetOutput(writer)
 }
 
 // Main loop
-func (self *Client) run() {
+func (self *Client) run(ctx context.Context) {
 
 	// push hook will be called from a go routine
 	self.backend.RegisterPushHook(func() {
@@ -152,62 +237,78 @@ func (self *Client) run() {
 		if remoteConn != nil { // remoteConn is global in comms.go
 			tcpSend(remoteConn, msg)
 		}
-		udpSend(self.logger, msg)
+		udpSend(msg)
 	})
 
 	for {
 		select {
-		case ev := <-self.watcher.Event:
-
-			self.logger.Println(ev)
+		case ev, ok := <-self.watcher.Events:
+			if !ok {
+				return
+			}
 
-			isCreate := ev.Mask&inotify.IN_CREATE != 0
-			isDir := ev.Mask&inotify.IN_ISDIR != 0
+			l.Debug("watch", ev)
 
-			if isCreate && isDir && self.backend.ShouldWatch(ev.Name) {
-				self.logger.Println("Adding watch", ev.Name)
-				self.watcher.AddWatch(ev.Name, INTERESTING)
+			// fsnotify doesn't tag events with whether the path is a
+			// directory, so a freshly-created path has to be stat'd to
+			// decide whether it needs its own watch.
+			if ev.Op&fsnotify.Create != 0 {
+				if info, statErr := os.Stat(ev.Name); statErr == nil && info.IsDir() && self.backend.ShouldWatch(ev.Name) {
+					l.Debug("watch", "Adding watch", ev.Name)
+					self.watcher.Add(ev.Name)
+				}
 			}
 
-            self.logger.Println("Calling Changed")
-			self.backend.Changed(ev.Name)
+            l.Debug("watch", "Calling Changed")
+			self.backend.Changed(ctx, ev.Name)
 
-		case err := <-self.watcher.Error:
-			self.logger.Println("error:", err)
+		case err, ok := <-self.watcher.Errors:
+			if !ok {
+				return
+			}
+			l.Warn("watch", "error:", err)
 
 		case <-self.incoming:
-			self.logger.Println("Remote update notification")
-			self.backend.Sync()
+			l.Info("net", "Remote update notification")
+			if err := self.backend.Sync(ctx); err != nil && !err.IsNoop() {
+				l.Warn("sync", err.Error())
+			}
+
+		case <-self.done:
+			l.Info("watch", "Shutting down, closing watcher")
+			self.watcher.Close()
+			return
 		}
 
 	}
 }
 
-// Add inotify watches on rootDir and all sub-dirs
-func (self *Client) addWatches() {
+// Add fsnotify watches on rootDir and all sub-dirs. Reports whether
+// rootDir itself could be watched: on network filesystems
+// (NFS/SMB/overlayfs) Add can fail even though nothing else is wrong,
+// and the caller falls back to polling when that happens.
+func (self *Client) addWatches() (rootWatched bool) {
+
+	rootWatched = true
 
 	addSingleWatch := func(path string, info os.FileInfo, err error) error {
 		if info.IsDir() && self.backend.ShouldWatch(path) {
-			self.logger.Println("Watching", path)
-			self.watcher.AddWatch(path, INTERESTING)
+			l.Debug("watch", "Watching", path)
+			if watchErr := self.watcher.Add(path); watchErr != nil {
+				l.Warn("watch", "could not watch", path, watchErr)
+				if path == self.rootDir {
+					rootWatched = false
+				}
+			}
 		}
 		return nil
 	}
 
 	err := filepath.Walk(self.rootDir, addSingleWatch)
 	if err != nil {
-		self.logger.Fatal(err)
+		l.Error("watch", err)
+		os.Exit(1)
 	}
-}
-
-// Utility function to inform user about something - for example file changes
-func Info(msg string) {
-	cmd := exec.Command("bup_info", msg)
-	cmd.Run()
-}
 
-// Utility function to warn user about something - for example a git error
-func Warn(msg string) {
-	cmd := exec.Command("bup_alert", msg)
-	cmd.Run()
+	return rootWatched
 }
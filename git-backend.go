@@ -1,8 +1,11 @@
 package main
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"sync"
 	"syscall"
@@ -19,83 +22,153 @@ type GitBackend struct {
 
 	rootDir string
 
+	done <-chan struct{} // closed on shutdown; aborts a pending syncLater sleep
+
+	wg sync.WaitGroup // tracks in-flight syncLater/Sync goroutines, for Wait()
+
 	syncLock      sync.Mutex
 	isSyncPending bool
     isSyncActive bool   // Ignore all events during sync
 
     lastEvent time.Time
+    lastSync  time.Time
 
 	pushHook func()
 }
 
-func NewGitBackend(config *Config) *GitBackend {
+func NewGitBackend(config *Config, done <-chan struct{}) *GitBackend {
 
 	rootDir := config.syncDir
 
 	gitPath, err := exec.LookPath("git")
 	if err != nil {
-		log.Fatal("Error looking for 'git' on path. ", err)
+		l.Error("git", "Error looking for 'git' on path. ", err)
+		os.Exit(1)
 	}
 
-	return &GitBackend{rootDir: rootDir, gitPath: gitPath}
+	return &GitBackend{rootDir: rootDir, gitPath: gitPath, done: done}
 }
 
 // A file or directory has been created
-func (self *GitBackend) Changed(filename string) {
-	if self.isGit(filename) || self.isSyncActive {
+func (self *GitBackend) Changed(ctx context.Context, filename string) {
+	if self.isGit(filename) || self.isConflictSide(filename) || self.isSyncActive {
 		return
 	}
     self.lastEvent = time.Now()
-	go self.syncLater()
+	self.wg.Add(1)
+	go func() {
+		defer self.wg.Done()
+		self.syncLater(ctx)
+	}()
+}
+
+// Wait blocks until any sync triggered by Changed or Invoke has finished.
+func (self *GitBackend) Wait() {
+	self.wg.Wait()
+}
+
+// Invoke runs a Sync triggered from outside the watch loop (the HTTP
+// /sync endpoint), tracked by the same WaitGroup as Changed's
+// debounced syncs so a SIGINT arriving mid-request still waits it out
+// instead of orphaning the git push.
+func (self *GitBackend) Invoke(ctx context.Context) BackendError {
+	self.wg.Add(1)
+	defer self.wg.Done()
+	return self.Sync(ctx)
 }
 
 // Run: git pull; git add --all ; git commit --all; git push
-func (self *GitBackend) Sync() error {
+func (self *GitBackend) Sync(ctx context.Context) BackendError {
 
-    log.Println("* Sync start")
+    l.Info("sync", "* Sync start")
     self.isSyncActive = true
 
-	var err *GitError
+	var err BackendError
 
 	// Pull first to ensure a fast-forward when we push
-	err = self.pull()
+	err = self.pull(ctx)
 	if err != nil {
         self.isSyncActive = false
 		return err
 	}
 
-	err = self.git("add", "--all")
-	if err != nil {
+	if gitErr := self.git(ctx, "add", "--all"); gitErr != nil {
         self.isSyncActive = false
-		return err
+		return gitErr
 	}
 
-    self.displayStatus("status", "--porcelain")
+    self.displayStatus(ctx, "status", "--porcelain")
 
-	err = self.git("commit", "--all", "--message=loftus")
-	if err != nil {
+	if gitErr := self.git(ctx, "commit", "--all", "--message=loftus"); gitErr != nil {
         // An err with status==1 means nothing to commit,
         // that counts as a clean exit
         self.isSyncActive = false
-        log.Println("* Sync end")
-		return err
+        l.Info("sync", "* Sync end")
+		return gitErr
 	}
 
-	err = self.push()
-	if err != nil {
+	if gitErr := self.push(ctx); gitErr != nil {
         self.isSyncActive = false
-        return err
+        return gitErr
 	}
 
     self.isSyncActive = false
-    log.Println("* Sync end")
+    self.lastSync = time.Now()
+    l.Info("sync", "* Sync end")
 	return nil
 }
 
+// StatusInfo reports a point-in-time snapshot for the HTTP status
+// endpoint: last sync time, whether a sync is pending, current HEAD,
+// and dirty file counts from status().
+func (self *GitBackend) StatusInfo() (*StatusInfo, error) {
+
+    head, err := self.headRef()
+    if err != nil {
+        return nil, err
+    }
+
+    created, modified, deleted := self.status(context.Background(), "status", "--porcelain")
+
+    return &StatusInfo{
+        LastSync: self.lastSync,
+        Pending:  self.isSyncPending,
+        Head:     head,
+        Created:  len(created),
+        Modified: len(modified),
+        Deleted:  len(deleted)}, nil
+}
+
+// DirtyPaths implements Poller for the poll-based fallback scanner: it
+// reports every path status() considers created, modified or deleted.
+func (self *GitBackend) DirtyPaths(ctx context.Context) []string {
+    created, modified, deleted := self.status(ctx, "status", "--porcelain")
+
+    var paths []string
+    paths = append(paths, created...)
+    paths = append(paths, modified...)
+    paths = append(paths, deleted...)
+    return paths
+}
+
+// Current HEAD, e.g. "a1b2c3d4"
+func (self *GitBackend) headRef() (string, error) {
+
+    cmd := exec.Command(self.gitPath, "rev-parse", "--short", "HEAD")
+    cmd.Dir = self.rootDir
+
+    output, err := cmd.Output()
+    if err != nil {
+        return "", err
+    }
+
+    return strings.TrimSpace(string(output)), nil
+}
+
 //Display summary of changes
-func (self *GitBackend) displayStatus(args ...string) {
+func (self *GitBackend) displayStatus(ctx context.Context, args ...string) {
 
-    created, modified, deleted := self.status(args...)
+    created, modified, deleted := self.status(ctx, args...)
 
     var msg string
     if len(created) == 1 {
@@ -117,7 +190,7 @@ func (self *GitBackend) displayStatus(args ...string) {
     }
 
     if len(msg) != 0 {
-        Info(msg)
+        l.Info("sync", msg)
     }
 }
 
@@ -128,23 +201,23 @@ func (self *GitBackend) RegisterPushHook(callback func()) {
 
 // Should the inotify watch watch the given path
 func (self *GitBackend) ShouldWatch(filename string) bool {
-	return !self.isGit(filename)
+	return !self.isGit(filename) && !self.isConflictSide(filename)
 }
 
 // Status of directory. Returns filenames created, modified or deleted.
-func (self *GitBackend) status(args ...string) (created []string, modified []string, deleted []string) {
+func (self *GitBackend) status(ctx context.Context, args ...string) (created []string, modified []string, deleted []string) {
 
-	cmd := exec.Command(self.gitPath, args...)
-	log.Println(strings.Join(cmd.Args, " "))
+	cmd := exec.CommandContext(ctx, self.gitPath, args...)
+	l.Debug("git", strings.Join(cmd.Args, " "))
 
 	cmd.Dir = self.rootDir
 
 	output, err := cmd.CombinedOutput()
     if err != nil {
-        log.Println(err)
+        l.Debug("git", err)
     }
     if len(output) > 0 {
-        log.Println(string(output))
+        l.Debug("git", string(output))
     }
 
     for _, line := range strings.Split(string(output), "\n") {
@@ -171,9 +244,13 @@ func (self *GitBackend) status(args ...string) (created []string, modified []str
             case 'D':
                 deleted = append(deleted, filename)
             case '?':
-                log.Println("Unknown. Need git add", filename)
+                // "??" is an untracked file (porcelain hasn't seen a
+                // "git add --all" yet) - treat it as created so
+                // DirtyPaths notices brand-new files on poll-only
+                // roots, not just edits to already-tracked ones.
+                created = append(created, filename)
             default:
-                log.Println("Other", status)
+                l.Warn("git", "Other", status)
         }
     }
 
@@ -185,8 +262,16 @@ func (self *GitBackend) isGit(filename string) bool {
 	return strings.Contains(filename, ".git")
 }
 
+// Is filename one of the .local/.remote side-files writeConflictSides
+// leaves behind? They're written by loftus itself while recovering
+// from a conflict, not a real local edit, so watching them would just
+// retrigger Changed -> syncLater -> Sync -> the same conflict forever.
+func (self *GitBackend) isConflictSide(filename string) bool {
+	return strings.HasSuffix(filename, ".local") || strings.HasSuffix(filename, ".remote")
+}
+
 // Schedule a synchronise for in a few seconds. Run it in go routine.
-func (self *GitBackend) syncLater() {
+func (self *GitBackend) syncLater(ctx context.Context) {
 
 	// ensure only once per time - might be able to use sync.Once instead (?)
 	self.syncLock.Lock()
@@ -198,66 +283,225 @@ func (self *GitBackend) syncLater() {
 	self.syncLock.Unlock()
 
     for time.Now().Sub(self.lastEvent) < (SYNC_IDLE_SECS * time.Second) {
-        time.Sleep(time.Second)
+        select {
+        case <-time.After(time.Second):
+        case <-self.done:
+            l.Info("sync", "syncLater aborted, shutting down")
+            self.isSyncPending = false
+            return
+        }
     }
 
-    log.Println("syncLater initiated sync")
-	self.Sync()
+    l.Debug("sync", "syncLater initiated sync")
+	if err := self.Sync(ctx); err != nil && !err.IsNoop() {
+		l.Warn("sync", err.Error())
+	}
 
 	self.isSyncPending = false
 }
 
 // Run: git push
-func (self *GitBackend) push() *GitError {
-	err := self.git("push")
+func (self *GitBackend) push(ctx context.Context) *GitError {
+	err := self.git(ctx, "push")
 	if err == nil && self.pushHook != nil {
 		go self.pushHook()
 	}
 	return err
 }
 
-// Run: git pull
-func (self *GitBackend) pull() *GitError {
+// Run: git pull. If the merge leaves unmerged paths, try to recover
+// automatically (abort, stash, retry); if that doesn't clear it up,
+// write both sides of each conflict to disk and surface a
+// ConflictError instead of a raw git dump.
+func (self *GitBackend) pull(ctx context.Context) BackendError {
 
-    var err *GitError
-
-    err = self.git("fetch")
+    err := self.git(ctx, "fetch")
     if err != nil {
         return err
     }
 
-    self.displayStatus("diff", "origin/master", "--name-status")
-	err = self.git("merge", "origin/master")
-	return err
+    self.displayStatus(ctx, "diff", "origin/master", "--name-status")
+
+    mergeErr := self.git(ctx, "merge", "origin/master")
+    if mergeErr == nil {
+        return nil
+    }
+
+    paths := self.conflictedPaths(ctx)
+    if len(paths) == 0 {
+        // Not a content conflict we know how to recover from (e.g.
+        // diverged history) - pass the raw git error up.
+        return mergeErr
+    }
+
+    return self.resolveConflict(ctx, paths)
+}
+
+// resolveConflict tries to recover from the merge left unmerged at
+// paths: abort it, stash whatever local changes are in the way, and
+// retry the merge. The conflict sides are read from the index before
+// the abort (the :2:/:3: stages only exist while the merge is still
+// in progress), but only written to <file>.local / <file>.remote if
+// the retry still fails - a successful auto-recovery must leave the
+// working tree exactly as git's own retry left it, with no extra
+// files to accidentally commit and push.
+func (self *GitBackend) resolveConflict(ctx context.Context, paths []string) BackendError {
+
+    l.Warn("sync", "Merge conflict in", len(paths), "file(s), attempting automatic recovery")
+
+    sides := self.readConflictSides(ctx, paths)
+
+    self.git(ctx, "merge", "--abort")
+
+    stashErr := self.git(ctx, "stash")
+    if stashErr != nil {
+        self.writeConflictSides(sides)
+        return &ConflictError{
+            paths: paths,
+            hint:  "could not stash local changes; resolve the .local/.remote files, remove them, then restart loftus"}
+    }
+
+    if self.git(ctx, "merge", "origin/master") == nil && self.git(ctx, "stash", "pop") == nil {
+        l.Info("sync", "Merge conflict resolved automatically after stash/retry")
+        return nil
+    }
+
+    self.writeConflictSides(sides)
+    return &ConflictError{
+        paths: paths,
+        hint:  "resolve the .local/.remote files in the working tree, remove them, then restart loftus; your pending changes are saved in 'git stash list'"}
+}
+
+// conflictedPaths returns the paths git status reports as unmerged
+// (status codes UU/AA/AU/UA/DD/DU/UD).
+func (self *GitBackend) conflictedPaths(ctx context.Context) []string {
+
+    cmd := exec.CommandContext(ctx, self.gitPath, "status", "--porcelain")
+    cmd.Dir = self.rootDir
+
+    output, err := cmd.Output()
+    if err != nil {
+        l.Warn("git", err)
+        return nil
+    }
+
+    var paths []string
+    for _, line := range strings.Split(string(output), "\n") {
+        if len(line) < 4 {
+            continue
+        }
+        switch line[:2] {
+        case "UU", "AA", "AU", "UA", "DD", "DU", "UD":
+            paths = append(paths, strings.TrimSpace(line[3:]))
+        }
+    }
+    return paths
+}
+
+// conflictSide holds the "ours"/"theirs" blobs read for one
+// conflicted path, so they can be written to disk later without
+// needing the merge to still be in progress.
+type conflictSide struct {
+    path   string
+    local  []byte
+    remote []byte
+}
+
+// readConflictSides reads the "ours" and "theirs" blobs for each
+// conflicted path while the merge is still in progress (the :2:/:3:
+// stages stop existing once it's aborted).
+func (self *GitBackend) readConflictSides(ctx context.Context, paths []string) []conflictSide {
+
+    sides := make([]conflictSide, 0, len(paths))
+    for _, path := range paths {
+        side := conflictSide{path: path}
+        if local, err := self.showStage(ctx, 2, path); err == nil {
+            side.local = local
+        }
+        if remote, err := self.showStage(ctx, 3, path); err == nil {
+            side.remote = remote
+        }
+        sides = append(sides, side)
+    }
+    return sides
+}
+
+// writeConflictSides flushes previously-read conflict blobs to
+// <path>.local and <path>.remote in the working tree, so the user has
+// both versions to hand once we give up.
+func (self *GitBackend) writeConflictSides(sides []conflictSide) {
+
+    for _, side := range sides {
+        if side.local != nil {
+            self.writeSideFile(side.path+".local", side.local)
+        }
+        if side.remote != nil {
+            self.writeSideFile(side.path+".remote", side.remote)
+        }
+    }
+}
+
+// showStage runs "git show :<stage>:<path>", returning the blob
+// content for that side of an in-progress merge conflict (2 = ours,
+// 3 = theirs).
+func (self *GitBackend) showStage(ctx context.Context, stage int, path string) ([]byte, error) {
+    cmd := exec.CommandContext(ctx, self.gitPath, "show", fmt.Sprintf(":%d:%s", stage, path))
+    cmd.Dir = self.rootDir
+    return cmd.Output()
+}
+
+func (self *GitBackend) writeSideFile(relPath string, content []byte) {
+    fullPath := filepath.Join(self.rootDir, relPath)
+    if err := os.WriteFile(fullPath, content, 0644); err != nil {
+        l.Warn("sync", "could not write conflict side", fullPath, err)
+    }
 }
 
 /* Runs a git command, returns nil if success, error if err
    Errors are not always bad. For example a "commit" that
    didn't have to do anything returns an error.
+
+   ctx is the kill context: if it's canceled while the command is
+   running (hammerTime after the shutdown grace period), the child is
+   force-killed rather than left to finish or orphaned.
 */
-func (self *GitBackend) git(gitCmd string, args ...string) *GitError {
+func (self *GitBackend) git(ctx context.Context, gitCmd string, args ...string) *GitError {
 
-	cmd := exec.Command(self.gitPath, append([]string{gitCmd}, args...)...)
+	cmd := exec.CommandContext(ctx, self.gitPath, append([]string{gitCmd}, args...)...)
 	cmd.Dir = self.rootDir
-	log.Println(strings.Join(cmd.Args, " "))
+	l.Debug("git", strings.Join(cmd.Args, " "))
 
 	output, err := cmd.CombinedOutput()
     if len(output) > 0 {
-        log.Println(string(output))
+        l.Debug("git", string(output))
     }
 
 	if err == nil {
         return nil
     }
 
-    exitStatus := err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus()
+    // err is not an *exec.ExitError when the command couldn't be run
+    // at all (e.g. ctx was already canceled by hammerTime before it
+    // started). A child killed mid-run by a canceled ctx still gives
+    // an *exec.ExitError, whose exit status is -1.
+    exitErr, isExitErr := err.(*exec.ExitError)
+    if !isExitErr {
+        l.Warn("git", err)
+        return &GitError{
+            cmd: strings.Join(cmd.Args, " "),
+            internalError: err,
+            output: string(output),
+            status: -1}
+    }
+
+    exitStatus := exitErr.Sys().(syscall.WaitStatus).ExitStatus()
     gitErr := &GitError{
         cmd: strings.Join(cmd.Args, " "),
         internalError: err,
         output: string(output),
         status: exitStatus}
     if exitStatus != 1 {            // 1 means command had nothing to do
-        log.Println(err)
+        l.Warn("git", err)
     }
     return gitErr
 }
@@ -276,3 +520,34 @@ func (self *GitError) Error() string {
 	msg += self.internalError.Error()
     return msg
 }
+
+// IsNoop reports whether the failing git command actually left nothing
+// to do (e.g. "commit" with no changes staged). Callers should treat
+// that as a clean exit rather than a real error.
+func (self *GitError) IsNoop() bool {
+    return self.status == 1
+}
+
+// ConflictError is returned when a pull leaves merge conflicts that
+// automatic stash/retry recovery couldn't clear. paths lists the
+// conflicted files (whose .local/.remote siblings now hold both
+// sides); hint is the actionable next step shown to the user instead
+// of a raw git dump.
+type ConflictError struct {
+    paths []string
+    hint  string
+}
+
+func (self *ConflictError) Error() string {
+    msg := "merge conflict in:\n"
+    for _, path := range self.paths {
+        msg += "  " + path + "\n"
+    }
+    msg += "\n" + self.hint
+    return msg
+}
+
+// A conflict is never a no-op; it always needs the user's attention.
+func (self *ConflictError) IsNoop() bool {
+    return false
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// StatusInfo is the snapshot reported by /status.
+type StatusInfo struct {
+	LastSync time.Time
+	Pending  bool
+	Head     string
+	Created  int
+	Modified int
+	Deleted  int
+}
+
+// Statuser is implemented by backends that can report a StatusInfo
+// snapshot. Currently only GitBackend; backends that can't (e.g.
+// RsyncBackend) just get a reduced /status response.
+type Statuser interface {
+	StatusInfo() (*StatusInfo, error)
+}
+
+// startHTTPServer exposes a small control surface over config.httpAddr:
+// /status, /sync (POST) and /archive/<ref>.tar.gz. This mirrors the
+// gitmirror pattern of pairing the sync loop with an HTTP surface so
+// loftus can be scripted, and other machines can pull a point-in-time
+// snapshot without installing git.
+func startHTTPServer(config *Config, backend Backend, ctx context.Context) {
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		statuser, ok := backend.(Statuser)
+		if !ok {
+			fmt.Fprintln(w, "status not available for this backend")
+			return
+		}
+
+		info, err := statuser.StatusInfo()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		fmt.Fprintf(w, "last_sync: %s\n", info.LastSync.Format(time.RFC3339))
+		fmt.Fprintf(w, "pending: %v\n", info.Pending)
+		fmt.Fprintf(w, "head: %s\n", info.Head)
+		fmt.Fprintf(w, "created: %d\n", info.Created)
+		fmt.Fprintf(w, "modified: %d\n", info.Modified)
+		fmt.Fprintf(w, "deleted: %d\n", info.Deleted)
+	})
+
+	mux.HandleFunc("/sync", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+
+		err := backend.Invoke(ctx)
+		if err != nil && !err.IsNoop() {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		fmt.Fprintln(w, "ok")
+	})
+
+	mux.HandleFunc("/archive/", func(w http.ResponseWriter, r *http.Request) {
+		ref := strings.TrimPrefix(r.URL.Path, "/archive/")
+		ref = strings.TrimSuffix(ref, ".tar.gz")
+		if ref == "" || strings.HasPrefix(ref, "-") || strings.ContainsAny(ref, "/ \t") {
+			http.Error(w, "invalid ref", http.StatusBadRequest)
+			return
+		}
+
+		// "--" stops option parsing so a ref can never be taken as a
+		// git flag (e.g. "--output=...", which would write the
+		// archive to a file in syncDir instead of streaming it here).
+		cmd := exec.CommandContext(ctx, "git", "archive", "--format=tar.gz", "--", ref)
+		cmd.Dir = config.syncDir
+		cmd.Stdout = w
+
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", "attachment; filename="+ref+".tar.gz")
+
+		if err := cmd.Run(); err != nil {
+			l.Warn("net", "archive error:", err)
+		}
+	})
+
+	l.Info("net", "HTTP control server listening on", config.httpAddr)
+	if err := http.ListenAndServe(config.httpAddr, mux); err != nil {
+		l.Error("net", "HTTP control server error:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,99 @@
+// Package logger provides a small leveled, per-facility logger for
+// loftus. Debug and Info lines are only written for facilities enabled
+// via LOFTUS_TRACE, so routine sync chatter can be silenced; Warn and
+// Error are always written, so merge conflicts and real failures are
+// never silently dropped.
+package logger
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+func (self Level) String() string {
+	switch self {
+	case Debug:
+		return "DEBUG"
+	case Info:
+		return "INFO"
+	case Warn:
+		return "WARN"
+	case Error:
+		return "ERROR"
+	default:
+		return "?"
+	}
+}
+
+type Logger struct {
+	mu      sync.Mutex
+	out     io.Writer
+	enabled map[string]bool
+}
+
+// New creates a Logger writing to out. Facilities to trace at
+// Debug/Info level are read from the LOFTUS_TRACE environment
+// variable, a comma-separated list such as "sync,watch,net,git".
+func New(out io.Writer) *Logger {
+	return &Logger{out: out, enabled: parseTrace(os.Getenv("LOFTUS_TRACE"))}
+}
+
+func parseTrace(v string) map[string]bool {
+	enabled := make(map[string]bool)
+	for _, facility := range strings.Split(v, ",") {
+		facility = strings.TrimSpace(facility)
+		if facility != "" {
+			enabled[facility] = true
+		}
+	}
+	return enabled
+}
+
+// SetOutput redirects future log lines to w. Tests use this to capture
+// output rather than scraping stderr.
+func (self *Logger) SetOutput(w io.Writer) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.out = w
+}
+
+func (self *Logger) Debug(facility string, v ...interface{}) {
+	self.log(Debug, facility, v...)
+}
+
+func (self *Logger) Info(facility string, v ...interface{}) {
+	self.log(Info, facility, v...)
+}
+
+func (self *Logger) Warn(facility string, v ...interface{}) {
+	self.log(Warn, facility, v...)
+}
+
+func (self *Logger) Error(facility string, v ...interface{}) {
+	self.log(Error, facility, v...)
+}
+
+func (self *Logger) log(level Level, facility string, v ...interface{}) {
+	if (level == Debug || level == Info) && !self.enabled[facility] {
+		return
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	fmt.Fprintf(self.out, "%s %s [%s] %s",
+		time.Now().Format(time.RFC3339), level, facility, fmt.Sprintln(v...))
+}
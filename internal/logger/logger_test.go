@@ -0,0 +1,50 @@
+package logger
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestFacilityGating(t *testing.T) {
+
+	var buf bytes.Buffer
+	l := New(&buf)
+	l.enabled = map[string]bool{"sync": true}
+
+	l.Debug("sync", "traced")
+	l.Debug("watch", "not traced")
+	l.Warn("watch", "always shown")
+
+	out := buf.String()
+
+	if !strings.Contains(out, "traced") {
+		t.Error("expected enabled facility to be logged:", out)
+	}
+	if strings.Contains(out, "not traced") {
+		t.Error("expected disabled facility to be suppressed:", out)
+	}
+	if !strings.Contains(out, "always shown") {
+		t.Error("expected Warn to bypass facility gating:", out)
+	}
+}
+
+func TestSetOutput(t *testing.T) {
+
+	var first, second bytes.Buffer
+	l := New(&first)
+
+	l.Error("git", "to first")
+	l.SetOutput(&second)
+	l.Error("git", "to second")
+
+	if !strings.Contains(first.String(), "to first") {
+		t.Error("expected first buffer to capture initial output")
+	}
+	if strings.Contains(first.String(), "to second") {
+		t.Error("expected SetOutput to redirect away from first buffer")
+	}
+	if !strings.Contains(second.String(), "to second") {
+		t.Error("expected second buffer to capture redirected output")
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Poller is implemented by backends that can report which paths are
+// currently dirty, for the poll-based fallback scanner. Only
+// GitBackend implements it today; RsyncBackend has no cheap way to
+// tell what's changed without doing the rsync itself.
+type Poller interface {
+	DirtyPaths(ctx context.Context) []string
+}
+
+// poll is the fallback sync loop for roots where filesystem events
+// aren't available: network filesystems (NFS/SMB/overlayfs), or any
+// root fsnotify couldn't Add a watch to. It periodically asks the
+// backend which paths are dirty and feeds them through Changed
+// exactly as a real watch event would; syncLater's own debounce
+// coalesces whatever a burst of them turns up, so poll only needs to
+// notice that something changed.
+func (self *Client) poll(ctx context.Context, interval time.Duration) {
+
+	poller, ok := self.backend.(Poller)
+	if !ok {
+		l.Warn("watch", "polling enabled but backend does not support polling")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, path := range poller.DirtyPaths(ctx) {
+				l.Debug("watch", "poll found dirty path", path)
+				self.backend.Changed(ctx, path)
+			}
+
+		case <-self.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RsyncBackend mirrors rootDir to remoteSpec with one-way
+// "rsync -a --delete" runs, for users without a git remote. It reuses
+// GitBackend's debounce shape (syncLater/isSyncPending/lastEvent) so
+// bursts of file events coalesce into a single rsync the same way they
+// coalesce into a single git commit.
+type RsyncBackend struct {
+	rsyncPath  string
+	rootDir    string
+	remoteSpec string
+
+	done <-chan struct{} // closed on shutdown; aborts a pending syncLater sleep
+
+	wg sync.WaitGroup // tracks in-flight syncLater/Sync goroutines, for Wait()
+
+	syncLock      sync.Mutex
+	isSyncPending bool
+	isSyncActive  bool
+
+	lastEvent time.Time
+
+	pushHook func()
+}
+
+func NewRsyncBackend(config *Config, done <-chan struct{}) *RsyncBackend {
+
+	rsyncPath, err := exec.LookPath("rsync")
+	if err != nil {
+		l.Error("sync", "Error looking for 'rsync' on path. ", err)
+		os.Exit(1)
+	}
+
+	if config.remoteSpec == "" {
+		l.Error("sync", "-backend=rsync requires -remote <user@host:/path>")
+		os.Exit(1)
+	}
+
+	return &RsyncBackend{
+		rootDir:    strings.TrimRight(config.syncDir, "/"),
+		rsyncPath:  rsyncPath,
+		remoteSpec: config.remoteSpec,
+		done:       done}
+}
+
+// A file or directory has been created, modified or deleted
+func (self *RsyncBackend) Changed(ctx context.Context, filename string) {
+	if self.isSyncActive {
+		return
+	}
+	self.lastEvent = time.Now()
+	self.wg.Add(1)
+	go func() {
+		defer self.wg.Done()
+		self.syncLater(ctx)
+	}()
+}
+
+// Wait blocks until any sync triggered by Changed or Invoke has finished.
+func (self *RsyncBackend) Wait() {
+	self.wg.Wait()
+}
+
+// Invoke runs a Sync triggered from outside the watch loop (the HTTP
+// /sync endpoint), tracked by the same WaitGroup as Changed's
+// debounced syncs so a SIGINT arriving mid-request still waits it out
+// instead of orphaning the rsync child.
+func (self *RsyncBackend) Invoke(ctx context.Context) BackendError {
+	self.wg.Add(1)
+	defer self.wg.Done()
+	return self.Sync(ctx)
+}
+
+// Run: rsync -a --delete rootDir remoteSpec
+func (self *RsyncBackend) Sync(ctx context.Context) BackendError {
+
+	l.Info("sync", "* Sync start")
+	self.isSyncActive = true
+
+	err := self.rsync(ctx, "-a", "--delete", self.rootDir+"/", self.remoteSpec)
+
+	self.isSyncActive = false
+	l.Info("sync", "* Sync end")
+
+	if err == nil && self.pushHook != nil {
+		go self.pushHook()
+	}
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Register the function to be called after we push to remote
+func (self *RsyncBackend) RegisterPushHook(callback func()) {
+	self.pushHook = callback
+}
+
+// rsync has no notion of a control directory to ignore, so watch
+// everything under rootDir
+func (self *RsyncBackend) ShouldWatch(filename string) bool {
+	return true
+}
+
+// Schedule a synchronise for in a few seconds. Run it in go routine.
+func (self *RsyncBackend) syncLater(ctx context.Context) {
+
+	self.syncLock.Lock()
+	if self.isSyncPending {
+		self.syncLock.Unlock()
+		return
+	}
+	self.isSyncPending = true
+	self.syncLock.Unlock()
+
+	for time.Now().Sub(self.lastEvent) < (SYNC_IDLE_SECS * time.Second) {
+		select {
+		case <-time.After(time.Second):
+		case <-self.done:
+			l.Info("sync", "syncLater aborted, shutting down")
+			self.isSyncPending = false
+			return
+		}
+	}
+
+	l.Debug("sync", "syncLater initiated sync")
+	if err := self.Sync(ctx); err != nil && !err.IsNoop() {
+		l.Warn("sync", err.Error())
+	}
+
+	self.isSyncPending = false
+}
+
+// ctx is the kill context: if it's canceled while rsync is running
+// (hammerTime after the shutdown grace period), the child is
+// force-killed rather than left to finish or orphaned.
+func (self *RsyncBackend) rsync(ctx context.Context, args ...string) *RsyncError {
+
+	cmd := exec.CommandContext(ctx, self.rsyncPath, args...)
+	l.Debug("sync", strings.Join(cmd.Args, " "))
+
+	output, err := cmd.CombinedOutput()
+	if len(output) > 0 {
+		l.Debug("sync", string(output))
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	exitErr, isExitErr := err.(*exec.ExitError)
+	if !isExitErr {
+		// rsync couldn't be run at all (e.g. ctx was already canceled)
+		l.Warn("sync", err)
+		return &RsyncError{
+			cmd:           strings.Join(cmd.Args, " "),
+			internalError: err,
+			output:        string(output),
+			status:        -1}
+	}
+
+	exitStatus := exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+	rsyncErr := &RsyncError{
+		cmd:           strings.Join(cmd.Args, " "),
+		internalError: err,
+		output:        string(output),
+		status:        exitStatus}
+	l.Warn("sync", err)
+	return rsyncErr
+}
+
+type RsyncError struct {
+	cmd           string
+	internalError error
+	output        string
+	status        int
+}
+
+// error implementation which displays rsync info
+func (self *RsyncError) Error() string {
+	msg := "rsync error running: " + self.cmd + "\n\n"
+	msg += self.output + "\n"
+	msg += self.internalError.Error()
+	return msg
+}
+
+// rsync has no equivalent of git's "nothing to commit"; every failure
+// is real
+func (self *RsyncError) IsNoop() bool {
+	return false
+}